@@ -13,12 +13,9 @@ import (
 	"time"
 
 	"github.com/tsuru/tsuru/auth"
-	"github.com/tsuru/tsuru/db"
-	"github.com/tsuru/tsuru/db/storage"
 	"github.com/tsuru/tsuru/log"
 	"github.com/tsuru/tsuru/permission"
 	"github.com/tsuru/tsuru/safe"
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -189,6 +186,8 @@ type Event struct {
 	eventData
 	logBuffer safe.Buffer
 	logWriter io.Writer
+	sinksMu   sync.Mutex
+	sinks     []*sinkQueue
 }
 
 type Opts struct {
@@ -212,13 +211,18 @@ func (e *Event) String() string {
 }
 
 type Filter struct {
-	Target         Target
-	KindType       kindType
-	KindName       string
-	OwnerType      ownerType
-	OwnerName      string
-	Since          time.Time
-	Until          time.Time
+	Target    Target
+	KindType  kindType
+	KindName  string
+	OwnerType ownerType
+	OwnerName string
+	Since     time.Time
+	Until     time.Time
+	// EndSince restricts the filter to events that finished at or after
+	// this time, unlike Since/Until which are matched against StartTime.
+	// mongoSource uses it to poll for newly finished events without
+	// missing long-running ones that started before the last poll.
+	EndSince       time.Time
 	Running        *bool
 	IncludeRemoved bool
 	Raw            bson.M
@@ -255,6 +259,9 @@ func (f *Filter) toQuery() bson.M {
 	if !f.Until.IsZero() {
 		timeParts = append(timeParts, bson.M{"starttime": bson.M{"$lte": f.Until}})
 	}
+	if !f.EndSince.IsZero() {
+		timeParts = append(timeParts, bson.M{"endtime": bson.M{"$gte": f.EndSince}})
+	}
 	if len(timeParts) != 0 {
 		query["$and"] = timeParts
 	}
@@ -273,45 +280,19 @@ func (f *Filter) toQuery() bson.M {
 }
 
 func GetRunning(target Target, kind string) (*Event, error) {
-	conn, err := db.Conn()
+	data, err := getStorage().FindRunning(target, kind)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-	coll := conn.Events()
-	var evt Event
-	err = coll.Find(bson.M{
-		"_id":       eventId{Target: target},
-		"kind.name": kind,
-		"running":   true,
-	}).One(&evt.eventData)
-	if err != nil {
-		if err == mgo.ErrNotFound {
-			return nil, ErrEventNotFound
-		}
-		return nil, err
-	}
-	return &evt, nil
+	return &Event{eventData: *data}, nil
 }
 
 func GetByID(id bson.ObjectId) (*Event, error) {
-	conn, err := db.Conn()
+	data, err := getStorage().FindByID(id)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-	coll := conn.Events()
-	var evt Event
-	err = coll.Find(bson.M{
-		"uniqueid": id,
-	}).One(&evt.eventData)
-	if err != nil {
-		if err == mgo.ErrNotFound {
-			return nil, ErrEventNotFound
-		}
-		return nil, err
-	}
-	return &evt, nil
+	return &Event{eventData: *data}, nil
 }
 
 func All() ([]Event, error) {
@@ -319,37 +300,7 @@ func All() ([]Event, error) {
 }
 
 func List(filter *Filter) ([]Event, error) {
-	limit := 100
-	skip := 0
-	var query bson.M
-	sort := "-starttime"
-	if filter != nil {
-		if filter.Limit != 0 {
-			limit = filter.Limit
-		}
-		if filter.Sort != "" {
-			sort = filter.Sort
-		}
-		if filter.Skip > 0 {
-			skip = filter.Skip
-		}
-		query = filter.toQuery()
-	}
-	conn, err := db.Conn()
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-	coll := conn.Events()
-	find := coll.Find(query).Sort(sort)
-	if limit > 0 {
-		find = find.Limit(limit)
-	}
-	if skip > 0 {
-		find = find.Skip(skip)
-	}
-	var allData []eventData
-	err = find.All(&allData)
+	allData, err := getStorage().List(filter)
 	if err != nil {
 		return nil, err
 	}
@@ -361,18 +312,7 @@ func List(filter *Filter) ([]Event, error) {
 }
 
 func MarkAsRemoved(target Target) error {
-	conn, err := db.Conn()
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-	coll := conn.Events()
-	now := time.Now().UTC()
-	_, err = coll.UpdateAll(bson.M{
-		"target":     target,
-		"removedate": bson.M{"$exists": false},
-	}, bson.M{"$set": bson.M{"removedate": now}})
-	return err
+	return getStorage().MarkRemoved(target)
 }
 
 func New(opts *Opts) (*Event, error) {
@@ -437,24 +377,13 @@ func newEvt(opts *Opts) (*Event, error) {
 		o.Type = OwnerTypeUser
 		o.Name = opts.Owner.GetUserName()
 	}
-	conn, err := db.Conn()
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-	coll := conn.Events()
+	store := getStorage()
+	locker := getLocker()
+	var err error
 	tSpec := getThrottling(&opts.Target, &k)
 	if tSpec != nil && tSpec.Max > 0 && tSpec.Time > 0 {
-		query := bson.M{
-			"target.name":  opts.Target.Name,
-			"target.value": opts.Target.Value,
-			"starttime":    bson.M{"$gt": time.Now().UTC().Add(-tSpec.Time)},
-		}
-		if tSpec.KindName != "" {
-			query["kind.name"] = tSpec.KindName
-		}
 		var c int
-		c, err = coll.Find(query).Count()
+		c, err = store.CountThrottled(opts.Target, tSpec.KindName, time.Now().UTC().Add(-tSpec.Time))
 		if err != nil {
 			return nil, err
 		}
@@ -475,26 +404,65 @@ func newEvt(opts *Opts) (*Event, error) {
 		Running:         true,
 		Cancelable:      opts.Cancelable,
 	}}
+	if err = locker.Acquire(opts.Target, lockExpireTimeout); err != nil {
+		return nil, err
+	}
 	maxRetries := 1
 	for i := 0; i < maxRetries+1; i++ {
-		err = coll.Insert(evt.eventData)
+		err = store.Insert(&evt.eventData)
 		if err == nil {
 			updater.addCh <- &opts.Target
+			evt.AddLogSink(newPersistLogSink(evt.UniqueID, store))
+			dispatchers.publish(ActionCreate, &evt)
 			return &evt, nil
 		}
-		if mgo.IsDup(err) {
-			if i >= maxRetries || !checkIsExpired(coll, evt.ID) {
-				var existing Event
-				err = coll.FindId(evt.ID).One(&existing.eventData)
-				if err == nil {
-					err = ErrEventLocked{event: &existing}
-				}
+		if !store.IsDup(err) {
+			locker.Release(opts.Target)
+			return nil, err
+		}
+		if i >= maxRetries || !clearExpiredLock(store, evt.ID) {
+			var existing *eventData
+			existing, err = store.FindByTarget(evt.ID)
+			if err == nil {
+				err = ErrEventLocked{event: &Event{eventData: *existing}}
 			}
+			locker.Release(opts.Target)
+			return nil, err
 		}
 	}
+	locker.Release(opts.Target)
 	return nil, err
 }
 
+// clearExpiredLock looks up the event record locking id's target and, if
+// its LockUpdateTime is older than lockExpireTimeout, finishes it with an
+// expiration error and returns true so newEvt can retry its insert. This
+// is the only thing that actually frees a target left locked by a crashed
+// process: it operates purely on Storage, so it runs the same way no
+// matter which Locker is selected, including ones (like etcdLocker) whose
+// own lock key lives in a completely different keyspace than the event
+// record itself.
+func clearExpiredLock(store Storage, id eventId) bool {
+	existing, err := store.FindByTarget(id)
+	if err != nil {
+		return false
+	}
+	lastUpdate := existing.LockUpdateTime.UTC()
+	if time.Now().UTC().Before(lastUpdate.Add(lockExpireTimeout)) {
+		return false
+	}
+	existing.Error = fmt.Sprintf("event expired, no update for %v", time.Since(lastUpdate))
+	existing.Running = false
+	existing.EndTime = time.Now().UTC()
+	oldID := existing.ID
+	existing.ID = eventId{ObjId: existing.UniqueID}
+	if err = store.Update(oldID, existing); err != nil {
+		log.Errorf("[events] [lock] error clearing expired event for %v: %s", id.Target, err)
+	}
+	dispatchers.publish(ActionDone, &Event{eventData: *existing})
+	return true
+}
+
 func (e *Event) Abort() error {
 	return e.done(nil, nil, true)
 }
@@ -516,76 +484,40 @@ func (e *Event) GetLogWriter() io.Writer {
 }
 
 func (e *Event) SetOtherCustomData(data interface{}) error {
-	conn, err := db.Conn()
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-	coll := conn.Events()
-	return coll.UpdateId(e.ID, bson.M{
-		"$set": bson.M{"othercustomdata": data},
-	})
-}
-
-func (e *Event) Logf(format string, params ...interface{}) {
-	log.Debugf(fmt.Sprintf("%s(%s)[%s] %s", e.Target.Name, e.Target.Value, e.Kind, format), params...)
-	format += "\n"
-	if e.logWriter != nil {
-		fmt.Fprintf(e.logWriter, format, params...)
-	}
-	fmt.Fprintf(&e.logBuffer, format, params...)
+	return getStorage().UpdateOther(e.ID, data)
 }
 
 func (e *Event) TryCancel(reason, owner string) error {
 	if !e.Cancelable || !e.Running {
 		return ErrNotCancelable
 	}
-	conn, err := db.Conn()
+	data, err := getStorage().UpdateCancelInfo(e.ID, cancelInfo{
+		Owner:     owner,
+		Reason:    reason,
+		StartTime: time.Now().UTC(),
+		Asked:     true,
+	}, false)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	coll := conn.Events()
-	change := mgo.Change{
-		Update: bson.M{"$set": bson.M{
-			"cancelinfo": cancelInfo{
-				Owner:     owner,
-				Reason:    reason,
-				StartTime: time.Now().UTC(),
-				Asked:     true,
-			},
-		}},
-		ReturnNew: true,
-	}
-	_, err = coll.FindId(e.ID).Apply(change, &e.eventData)
-	if err == mgo.ErrNotFound {
-		return ErrEventNotFound
-	}
-	return err
+	e.eventData = *data
+	return nil
 }
 
 func (e *Event) AckCancel() error {
 	if !e.Cancelable || !e.Running {
 		return ErrNotCancelable
 	}
-	conn, err := db.Conn()
+	data, err := getStorage().UpdateCancelInfo(e.ID, cancelInfo{
+		AckTime:  time.Now().UTC(),
+		Canceled: true,
+	}, true)
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	coll := conn.Events()
-	change := mgo.Change{
-		Update: bson.M{"$set": bson.M{
-			"cancelinfo.acktime":  time.Now().UTC(),
-			"cancelinfo.canceled": true,
-		}},
-		ReturnNew: true,
-	}
-	_, err = coll.Find(bson.M{"_id": e.ID, "cancelinfo.asked": true}).Apply(change, &e.eventData)
-	if err == mgo.ErrNotFound {
-		return ErrEventNotFound
-	}
-	return err
+	e.eventData = *data
+	dispatchers.publish(ActionCancelAck, e)
+	return nil
 }
 
 func (e *Event) StartData(value interface{}) error {
@@ -621,14 +553,11 @@ func (e *Event) done(evtErr error, customData interface{}, abort bool) (err erro
 		}
 	}()
 	updater.removeCh <- &e.Target
-	conn, err := db.Conn()
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-	coll := conn.Events()
+	store := getStorage()
+	defer getLocker().Release(e.Target)
+	defer e.closeSinks()
 	if abort {
-		return coll.RemoveId(e.ID)
+		return store.Remove(e.ID)
 	}
 	if evtErr != nil {
 		e.Error = evtErr.Error()
@@ -639,14 +568,17 @@ func (e *Event) done(evtErr error, customData interface{}, abort bool) (err erro
 	e.EndCustomData = customData
 	e.Running = false
 	e.Log = e.logBuffer.String()
-	var dbEvt Event
-	err = coll.FindId(e.ID).One(&dbEvt.eventData)
+	dbEvt, err := store.FindByTarget(e.ID)
 	if err == nil {
 		e.OtherCustomData = dbEvt.OtherCustomData
 	}
-	defer coll.RemoveId(e.ID)
+	oldID := e.ID
 	e.ID = eventId{ObjId: e.UniqueID}
-	return coll.Insert(e.eventData)
+	err = store.Update(oldID, &e.eventData)
+	if err == nil {
+		dispatchers.publish(ActionDone, e)
+	}
+	return err
 }
 
 type lockUpdater struct {
@@ -684,36 +616,21 @@ func (l *lockUpdater) spin() {
 			return
 		case <-time.After(lockUpdateInterval):
 		}
-		conn, err := db.Conn()
-		if err != nil {
-			log.Errorf("[events] [lock update] error getting db conn: %s", err)
+		if len(set) == 0 {
 			continue
 		}
-		coll := conn.Events()
-		slice := make([]interface{}, len(set))
-		i := 0
-		for id := range set {
-			slice[i], _ = id.GetBSON()
-			i++
+		targets := make([]Target, 0, len(set))
+		for target := range set {
+			targets = append(targets, target)
 		}
-		err = coll.Update(bson.M{"_id": bson.M{"$in": slice}}, bson.M{"$set": bson.M{"lockupdatetime": time.Now().UTC()}})
-		if err != nil && err != mgo.ErrNotFound {
+		if err := getStorage().RefreshLocks(targets); err != nil {
 			log.Errorf("[events] [lock update] error updating: %s", err)
 		}
-		conn.Close()
-	}
-}
-
-func checkIsExpired(coll *storage.Collection, id interface{}) bool {
-	var existingEvt Event
-	err := coll.FindId(id).One(&existingEvt.eventData)
-	if err == nil {
-		now := time.Now().UTC()
-		lastUpdate := existingEvt.LockUpdateTime.UTC()
-		if now.After(lastUpdate.Add(lockExpireTimeout)) {
-			existingEvt.Done(fmt.Errorf("event expired, no update for %v", time.Since(lastUpdate)))
-			return true
+		locker := getLocker()
+		for _, target := range targets {
+			if err := locker.Refresh(target, lockExpireTimeout); err != nil {
+				log.Errorf("[events] [lock update] error updating: %s", err)
+			}
 		}
 	}
-	return false
 }
@@ -0,0 +1,85 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"sync"
+	"time"
+)
+
+// Locker is the interface implemented by every event locking backend.
+// newEvt uses it to make sure only one event can be running for a given
+// Target at a time, and done/Abort use it to release that lock once the
+// event finishes.
+type Locker interface {
+	// Acquire takes the lock for target, valid for ttl. Implementations
+	// that keep lock state of their own fail with ErrEventLocked (wrapping
+	// the event already holding it, when Storage has it) while another
+	// event owns the lock. mongoLocker keeps none and always succeeds: for
+	// it, the unique insert in newEvt is the lock.
+	Acquire(target Target, ttl time.Duration) error
+	// Refresh extends the lock for target by ttl, called periodically by
+	// lockUpdater while an event is still running.
+	Refresh(target Target, ttl time.Duration) error
+	// Release frees the lock for target, called once an event finishes.
+	Release(target Target) error
+}
+
+var (
+	lockersMu sync.RWMutex
+	lockers   = make(map[string]Locker)
+
+	lockerMu      sync.RWMutex
+	currentLocker Locker
+)
+
+// RegisterLocker makes a Locker implementation available under name, so it
+// can later be selected with SetLocker.
+func RegisterLocker(name string, locker Locker) {
+	lockersMu.Lock()
+	defer lockersMu.Unlock()
+	lockers[name] = locker
+}
+
+// GetLocker returns the Locker implementation previously registered under
+// name, or an error if none was registered.
+func GetLocker(name string) (Locker, error) {
+	lockersMu.RLock()
+	defer lockersMu.RUnlock()
+	locker, ok := lockers[name]
+	if !ok {
+		return nil, ErrValidation("unknown locker " + name)
+	}
+	return locker, nil
+}
+
+// SetLocker overrides the Locker implementation used by newEvt and the
+// lock updater. It defaults to mongoLocker, a no-op that leaves tsuru's
+// original behavior untouched: the unique `_id` insert in newEvt is the
+// actual lock, and clearExpiredLock fixes up stale locks regardless of
+// backend. Operators deploying against etcd can switch to a Locker with
+// native lease/TTL semantics, such as the one returned by NewEtcdLocker,
+// whose lock key expires with its lease when a tsuru API crashes. Such a
+// Locker does not remove the crashed event's running record from
+// Storage: the next newEvt for the target still frees it through
+// clearExpiredLock once its lockupdatetime is stale.
+func SetLocker(locker Locker) {
+	lockerMu.Lock()
+	defer lockerMu.Unlock()
+	currentLocker = locker
+}
+
+func getLocker() Locker {
+	lockerMu.RLock()
+	defer lockerMu.RUnlock()
+	if currentLocker == nil {
+		return defaultMongoLocker
+	}
+	return currentLocker
+}
+
+func init() {
+	RegisterLocker("mongodb", defaultMongoLocker)
+}
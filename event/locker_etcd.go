@@ -0,0 +1,91 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"context"
+	"time"
+
+	etcd "go.etcd.io/etcd/clientv3"
+)
+
+// etcdLockKeyPrefix namespaces lock keys away from the event data keys
+// used by etcdStorage, so the two can be mixed independently (an operator
+// may run etcdLocker against Mongo-backed storage, or vice versa).
+const etcdLockKeyPrefix = "/tsuru/events/locks/"
+
+// etcdLocker is a Locker implementation on top of etcd v3 leases: Acquire
+// creates a lease scoped to ttl and writes the lock key only if it
+// doesn't already exist, so the lock key of a crashed tsuru API goes away
+// once its lease expires. The lease does not remove the crashed event's
+// running record from Storage: the next newEvt for the target still finds
+// it on insert and frees the target through clearExpiredLock once its
+// lockupdatetime is stale.
+type etcdLocker struct {
+	client *etcd.Client
+}
+
+// NewEtcdLocker creates a Locker on top of an already connected etcd v3
+// client. Callers typically register it with event.RegisterLocker and
+// select it with event.SetLocker.
+func NewEtcdLocker(client *etcd.Client) Locker {
+	return &etcdLocker{client: client}
+}
+
+func (l *etcdLocker) lockKey(target Target) string {
+	return etcdLockKeyPrefix + target.Name + "/" + target.Value
+}
+
+func (l *etcdLocker) Acquire(target Target, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	lease, err := l.client.Grant(ctx, int64(ttl/time.Second))
+	if err != nil {
+		return err
+	}
+	key := l.lockKey(target)
+	txn := l.client.Txn(ctx).
+		If(etcd.Compare(etcd.CreateRevision(key), "=", 0)).
+		Then(etcd.OpPut(key, "", etcd.WithLease(lease.ID)))
+	resp, err := txn.Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		// Look the conflicting event up through getStorage, not a freshly
+		// built etcdStorage: Locker and Storage are selected independently,
+		// so whatever is locked here may well be recorded in mongoStorage
+		// or another backend entirely.
+		existing, findErr := getStorage().FindByTarget(eventId{Target: target})
+		if findErr == nil {
+			return ErrEventLocked{event: &Event{eventData: *existing}}
+		}
+		return ErrEventLocked{}
+	}
+	return nil
+}
+
+// Refresh renews the lease granted by Acquire with KeepAliveOnce, which
+// extends it by the TTL it was granted with; ttl is not used.
+func (l *etcdLocker) Refresh(target Target, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := l.client.Get(ctx, l.lockKey(target))
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return ErrEventNotFound
+	}
+	_, err = l.client.KeepAliveOnce(ctx, etcd.LeaseID(resp.Kvs[0].Lease))
+	return err
+}
+
+func (l *etcdLocker) Release(target Target) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := l.client.Delete(ctx, l.lockKey(target))
+	return err
+}
@@ -0,0 +1,60 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEtcdLockerAcquireRefreshRelease(t *testing.T) {
+	client, teardown := newTestEtcdClient(t)
+	defer teardown()
+	locker := NewEtcdLocker(client)
+
+	target := Target{Name: "app", Value: "myapp"}
+	if err := locker.Acquire(target, time.Minute); err != nil {
+		t.Fatalf("unexpected error acquiring the lock: %s", err)
+	}
+	if err := locker.Refresh(target, time.Minute); err != nil {
+		t.Fatalf("unexpected error refreshing the lock: %s", err)
+	}
+	if err := locker.Release(target); err != nil {
+		t.Fatalf("unexpected error releasing the lock: %s", err)
+	}
+	if err := locker.Acquire(target, time.Minute); err != nil {
+		t.Fatalf("expected the lock to be acquirable again after release, got: %s", err)
+	}
+}
+
+func TestEtcdLockerAcquireRejectsConcurrentLock(t *testing.T) {
+	client, teardown := newTestEtcdClient(t)
+	defer teardown()
+	locker := NewEtcdLocker(client)
+	SetStorage(newFakeStorage())
+	defer SetStorage(nil)
+
+	target := Target{Name: "app", Value: "myapp"}
+	if err := locker.Acquire(target, time.Minute); err != nil {
+		t.Fatalf("unexpected error acquiring the lock: %s", err)
+	}
+	defer locker.Release(target)
+
+	err := locker.Acquire(target, time.Minute)
+	if _, ok := err.(ErrEventLocked); !ok {
+		t.Fatalf("expected ErrEventLocked for a concurrently held lock, got: %v", err)
+	}
+}
+
+func TestEtcdLockerRefreshUnknownTarget(t *testing.T) {
+	client, teardown := newTestEtcdClient(t)
+	defer teardown()
+	locker := NewEtcdLocker(client)
+
+	err := locker.Refresh(Target{Name: "app", Value: "missing"}, time.Minute)
+	if err != ErrEventNotFound {
+		t.Fatalf("expected ErrEventNotFound for an unlocked target, got: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestClearExpiredLockFreshLock(t *testing.T) {
+	store := newFakeStorage()
+	target := Target{Name: "app", Value: "myapp"}
+	store.running[target] = eventData{
+		ID:             eventId{Target: target},
+		UniqueID:       bson.NewObjectId(),
+		Target:         target,
+		Running:        true,
+		LockUpdateTime: time.Now().UTC(),
+	}
+	if clearExpiredLock(store, eventId{Target: target}) {
+		t.Fatal("expected clearExpiredLock to leave a fresh lock alone")
+	}
+	if _, ok := store.running[target]; !ok {
+		t.Fatal("expected the running record to still be present")
+	}
+}
+
+func TestClearExpiredLockExpiredLock(t *testing.T) {
+	store := newFakeStorage()
+	target := Target{Name: "app", Value: "myapp"}
+	store.running[target] = eventData{
+		ID:             eventId{Target: target},
+		UniqueID:       bson.NewObjectId(),
+		Target:         target,
+		Running:        true,
+		LockUpdateTime: time.Now().UTC().Add(-2 * lockExpireTimeout),
+	}
+	if !clearExpiredLock(store, eventId{Target: target}) {
+		t.Fatal("expected clearExpiredLock to clear a stale lock")
+	}
+	if _, ok := store.running[target]; ok {
+		t.Fatal("expected the running record to have been finished and removed")
+	}
+	if len(store.finished) != 1 {
+		t.Fatalf("expected the stale event to be recorded as finished, got %d", len(store.finished))
+	}
+}
+
+// TestNewEvtRecoversFromCrashedLock exercises the scenario the pluggable
+// Locker was introduced for: a process dies while holding the lock for a
+// target, leaving a stale running record behind, and a later newEvt call
+// for the same target must self-heal instead of being stuck behind
+// ErrEventLocked forever.
+func TestNewEvtRecoversFromCrashedLock(t *testing.T) {
+	store := newFakeStorage()
+	SetStorage(store)
+	defer SetStorage(nil)
+	SetLocker(defaultMongoLocker)
+	defer SetLocker(nil)
+
+	target := Target{Name: "app", Value: "myapp"}
+	store.running[target] = eventData{
+		ID:             eventId{Target: target},
+		UniqueID:       bson.NewObjectId(),
+		Target:         target,
+		Kind:           kind{Type: KindTypeInternal, Name: "healer"},
+		Running:        true,
+		LockUpdateTime: time.Now().UTC().Add(-2 * lockExpireTimeout),
+	}
+
+	evt, err := NewInternal(&Opts{Target: target, InternalKind: "healer"})
+	if err != nil {
+		t.Fatalf("expected newEvt to recover from the crashed lock, got: %s", err)
+	}
+	if evt == nil {
+		t.Fatal("expected a non-nil event")
+	}
+	evt.Done(nil)
+}
+
+func TestNewEvtRejectsLiveLock(t *testing.T) {
+	store := newFakeStorage()
+	SetStorage(store)
+	defer SetStorage(nil)
+	SetLocker(defaultMongoLocker)
+	defer SetLocker(nil)
+
+	target := Target{Name: "app", Value: "myapp"}
+	store.running[target] = eventData{
+		ID:             eventId{Target: target},
+		UniqueID:       bson.NewObjectId(),
+		Target:         target,
+		Kind:           kind{Type: KindTypeInternal, Name: "healer"},
+		Running:        true,
+		LockUpdateTime: time.Now().UTC(),
+	}
+
+	_, err := NewInternal(&Opts{Target: target, InternalKind: "healer"})
+	if _, ok := err.(ErrEventLocked); !ok {
+		t.Fatalf("expected ErrEventLocked for a live lock, got: %#v", err)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// countingStorage wraps fakeStorage to count how many times RefreshLocks
+// is called, so the lock updater can be checked to still batch every
+// tracked target into a single call per tick instead of one call each.
+// refreshCalls is written from lockUpdater.spin's goroutine and read
+// from the test goroutine, so it must be accessed atomically.
+type countingStorage struct {
+	*fakeStorage
+	refreshCalls int32
+}
+
+func (s *countingStorage) RefreshLocks(targets []Target) error {
+	atomic.AddInt32(&s.refreshCalls, 1)
+	return s.fakeStorage.RefreshLocks(targets)
+}
+
+func TestLockUpdaterBatchesRefresh(t *testing.T) {
+	store := &countingStorage{fakeStorage: newFakeStorage()}
+	SetStorage(store)
+	defer SetStorage(nil)
+
+	oldInterval := lockUpdateInterval
+	lockUpdateInterval = 10 * time.Millisecond
+	defer func() { lockUpdateInterval = oldInterval }()
+
+	targets := []Target{
+		{Name: "app", Value: "app1"},
+		{Name: "app", Value: "app2"},
+		{Name: "app", Value: "app3"},
+	}
+	for _, target := range targets {
+		store.putRunning(eventData{
+			ID:             eventId{Target: target},
+			UniqueID:       bson.NewObjectId(),
+			Target:         target,
+			Running:        true,
+			LockUpdateTime: time.Now().UTC(),
+		})
+	}
+
+	l := &lockUpdater{
+		addCh:    make(chan *Target),
+		removeCh: make(chan *Target),
+		stopCh:   make(chan struct{}),
+	}
+	go l.spin()
+	defer l.stop()
+
+	for i := range targets {
+		l.addCh <- &targets[i]
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	calls := atomic.LoadInt32(&store.refreshCalls)
+	if calls == 0 {
+		t.Fatal("expected RefreshLocks to have been called at least once")
+	}
+	if calls > 10 {
+		t.Fatalf("expected RefreshLocks to be called once per tick for every target combined, got %d calls for 3 targets", calls)
+	}
+}
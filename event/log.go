@@ -0,0 +1,227 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tsuru/tsuru/log"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// LogLine is a single chunk of an event's log stream, as produced by Logf
+// and fanned out to every registered Sink.
+type LogLine struct {
+	Time    time.Time
+	Message string
+}
+
+// Sink receives every LogLine logged by an Event through Logf, in order.
+// Write should not block for long: Logf dispatches to sinks over a
+// bounded, per-sink queue and drops the oldest queued line rather than
+// stall the caller when a sink falls behind.
+type Sink interface {
+	Write(LogLine) error
+	Close() error
+}
+
+// sinkQueueSize bounds how many LogLines a sinkQueue buffers for a slow
+// Sink before dropping the oldest one still queued.
+const sinkQueueSize = 1000
+
+// sinkQueue adapts a Sink into a bounded, non-blocking channel so Logf
+// never waits on a Sink's Write call. mu guards lineCh against push()
+// racing close(): without it, a Logf goroutine that already read this
+// queue from Event.sinks could send on lineCh after closeSinks() closes
+// it, panicking instead of just dropping the line.
+type sinkQueue struct {
+	mu     sync.Mutex
+	closed bool
+	sink   Sink
+	lineCh chan LogLine
+	doneCh chan struct{}
+}
+
+func newSinkQueue(sink Sink) *sinkQueue {
+	q := &sinkQueue{
+		sink:   sink,
+		lineCh: make(chan LogLine, sinkQueueSize),
+		doneCh: make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *sinkQueue) run() {
+	defer close(q.doneCh)
+	for line := range q.lineCh {
+		if err := q.sink.Write(line); err != nil {
+			log.Errorf("[events] [log sink] error writing log line: %s", err)
+		}
+	}
+}
+
+// push enqueues line, dropping the oldest queued line instead of blocking
+// when the sink has fallen behind. A no-op once the queue is closed.
+func (q *sinkQueue) push(line LogLine) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	select {
+	case q.lineCh <- line:
+		return
+	default:
+	}
+	select {
+	case <-q.lineCh:
+	default:
+	}
+	select {
+	case q.lineCh <- line:
+	default:
+	}
+}
+
+func (q *sinkQueue) close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.lineCh)
+	q.mu.Unlock()
+	<-q.doneCh
+	if err := q.sink.Close(); err != nil {
+		log.Errorf("[events] [log sink] error closing sink: %s", err)
+	}
+}
+
+// persistLogSink is the Sink every Event gets by default, streaming each
+// LogLine into the pluggable Storage backend (the event_logs collection,
+// for mongoStorage) as it's produced, instead of only writing the whole
+// buffered log once in done(). This is what makes Event.LogStream able to
+// tail a deploy's log from a different tsuru API process than the one
+// running it.
+type persistLogSink struct {
+	uniqueID bson.ObjectId
+	store    Storage
+}
+
+func newPersistLogSink(uniqueID bson.ObjectId, store Storage) Sink {
+	return &persistLogSink{uniqueID: uniqueID, store: store}
+}
+
+func (s *persistLogSink) Write(line LogLine) error {
+	return s.store.AppendLog(s.uniqueID, line)
+}
+
+func (s *persistLogSink) Close() error {
+	return nil
+}
+
+// AddLogSink registers sink to receive every LogLine produced by Logf from
+// this point on, through a bounded per-sink queue. The sink stops
+// receiving lines, and is closed, once the event finishes through Done,
+// DoneCustomData or Abort.
+func (e *Event) AddLogSink(sink Sink) {
+	e.sinksMu.Lock()
+	defer e.sinksMu.Unlock()
+	e.sinks = append(e.sinks, newSinkQueue(sink))
+}
+
+// closeSinks stops every registered sink's queue. Called once the event
+// is done.
+func (e *Event) closeSinks() {
+	e.sinksMu.Lock()
+	sinks := e.sinks
+	e.sinks = nil
+	e.sinksMu.Unlock()
+	for _, q := range sinks {
+		q.close()
+	}
+}
+
+// logStreamPollInterval controls how often LogStream re-reads persisted
+// log chunks from Storage.
+var logStreamPollInterval = 2 * time.Second
+
+// LogStream returns a channel fed with every LogLine persisted for this
+// event, old and new, so callers can tail a deploy's log from a different
+// tsuru API process than the one running it: AddLogSink only fans out to
+// sinks registered on the very *Event instance handling the event, which
+// another process (or another GetByID/GetRunning copy in this one) has no
+// way to reach, while every line is also written to Storage as it's
+// produced through persistLogSink. The channel is closed when ctx is done
+// or once the event is seen as finished and its last lines have been
+// read.
+func (e *Event) LogStream(ctx context.Context) (<-chan LogLine, error) {
+	ch := make(chan LogLine, sinkQueueSize)
+	go e.streamLog(ctx, ch)
+	return ch, nil
+}
+
+func (e *Event) streamLog(ctx context.Context, ch chan<- LogLine) {
+	defer close(ch)
+	store := getStorage()
+	seen := 0
+	for {
+		lines, err := store.LogLines(e.UniqueID)
+		if err != nil {
+			log.Errorf("[events] [log stream] error reading log lines: %s", err)
+		} else {
+			for _, line := range lines[seen:] {
+				select {
+				case ch <- line:
+				case <-ctx.Done():
+					return
+				}
+			}
+			seen = len(lines)
+		}
+		data, err := store.FindByID(e.UniqueID)
+		if err == nil && !data.Running {
+			// The event finished between our last two reads: read once
+			// more to flush whatever was appended right before it did,
+			// then stop instead of waiting out a full poll interval.
+			if lines, err = store.LogLines(e.UniqueID); err == nil {
+				for _, line := range lines[seen:] {
+					select {
+					case ch <- line:
+					case <-ctx.Done():
+					}
+				}
+			}
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(logStreamPollInterval):
+		}
+	}
+}
+
+func (e *Event) Logf(format string, params ...interface{}) {
+	log.Debugf(fmt.Sprintf("%s(%s)[%s] %s", e.Target.Name, e.Target.Value, e.Kind, format), params...)
+	format += "\n"
+	if e.logWriter != nil {
+		fmt.Fprintf(e.logWriter, format, params...)
+	}
+	message := fmt.Sprintf(format, params...)
+	fmt.Fprint(&e.logBuffer, message)
+	line := LogLine{Time: time.Now().UTC(), Message: message}
+	e.sinksMu.Lock()
+	sinks := e.sinks
+	e.sinksMu.Unlock()
+	for _, q := range sinks {
+		q.push(line)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type recordingSink struct {
+	mu    sync.Mutex
+	lines []LogLine
+}
+
+func (s *recordingSink) Write(line LogLine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(s.lines, line)
+	return nil
+}
+
+func (s *recordingSink) Close() error { return nil }
+
+// TestSinkQueuePushDuringClose exercises sinkQueue's close/push race: a
+// goroutine pushing lines concurrently with close must never panic by
+// sending on the channel after it's closed.
+func TestSinkQueuePushDuringClose(t *testing.T) {
+	q := newSinkQueue(&recordingSink{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			q.push(LogLine{Message: "line"})
+		}
+	}()
+	q.close()
+	wg.Wait()
+}
+
+// TestLogStreamTailsAcrossInstances ensures LogStream can tail an event's
+// log by polling Storage, not just the in-memory sinks of the *Event
+// pointer it's called on -- simulating a different process (or a
+// GetByID copy) from the one that produced the lines.
+func TestLogStreamTailsAcrossInstances(t *testing.T) {
+	store := newFakeStorage()
+	SetStorage(store)
+	defer SetStorage(nil)
+
+	oldInterval := logStreamPollInterval
+	logStreamPollInterval = 10 * time.Millisecond
+	defer func() { logStreamPollInterval = oldInterval }()
+
+	uniqueID := bson.NewObjectId()
+	target := Target{Name: "app", Value: "myapp"}
+	evt := eventData{
+		ID:             eventId{Target: target},
+		UniqueID:       uniqueID,
+		Target:         target,
+		Running:        true,
+		LockUpdateTime: time.Now().UTC(),
+	}
+	store.putRunning(evt)
+	store.AppendLog(uniqueID, LogLine{Message: "first"})
+
+	remote := &Event{eventData: eventData{UniqueID: uniqueID}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, err := remote.LogStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := <-ch
+	if first.Message != "first" {
+		t.Fatalf("expected to tail the already persisted line, got %q", first.Message)
+	}
+
+	store.AppendLog(uniqueID, LogLine{Message: "second"})
+	second := <-ch
+	if second.Message != "second" {
+		t.Fatalf("expected to tail a line appended after the stream started, got %q", second.Message)
+	}
+
+	evt.Running = false
+	store.finishRunning(target, evt)
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("expected no more lines after the event finished")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the stream to close once the event was seen as finished")
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Storage is the interface implemented by every event persistence backend.
+// It abstracts away the queries every exported function in this package
+// used to build directly against a MongoDB collection, so that tsuru can
+// be deployed against alternative stores.
+type Storage interface {
+	// Insert stores a newly created event. It must fail with a storage
+	// specific "duplicate key" style error (checked with IsDup) when an
+	// event already exists for the same Target.
+	Insert(evt *eventData) error
+	// IsDup reports whether err, as returned by Insert, represents a
+	// duplicate key error, meaning another event already holds the lock
+	// for the same target.
+	IsDup(err error) bool
+	// FindByTarget returns the running event locked for the given target,
+	// used both to detect lock collisions and to look up the currently
+	// running event for a kind.
+	FindByTarget(id eventId) (*eventData, error)
+	// FindByID returns the (possibly already finished) event with the
+	// given UniqueID.
+	FindByID(uniqueID bson.ObjectId) (*eventData, error)
+	// FindRunning returns the running event matching target and kind, if
+	// any.
+	FindRunning(target Target, kind string) (*eventData, error)
+	// List returns all events matching the query built from a Filter.
+	List(filter *Filter) ([]eventData, error)
+	// MarkRemoved flags every non-removed event for target as removed.
+	MarkRemoved(target Target) error
+	// RefreshLocks bumps the lock update time for every target in the set,
+	// used by the lock updater goroutine to keep long running events
+	// alive.
+	RefreshLocks(targets []Target) error
+	// Remove deletes the in-progress event with the given id, used both on
+	// Abort and when migrating a running event into its finished record.
+	Remove(id eventId) error
+	// Update replaces the stored event data for the given id.
+	Update(id eventId, evt *eventData) error
+	// UpdateOther updates only the OtherCustomData field of the event
+	// matching id.
+	UpdateOther(id eventId, data interface{}) error
+	// UpdateCancelInfo applies a partial update to the cancelinfo field
+	// and returns the up to date event. requireAsked restricts the update
+	// to events whose cancelinfo.asked is already true (used by
+	// AckCancel).
+	UpdateCancelInfo(id eventId, info cancelInfo, requireAsked bool) (*eventData, error)
+	// CountThrottled returns how many events match the throttling query
+	// for a target/kind pair within the given time window.
+	CountThrottled(target Target, kindName string, since time.Time) (int, error)
+	// AppendLog persists one chunk of an event's log stream, so a crash
+	// doesn't lose everything buffered in memory since the event started.
+	AppendLog(uniqueID bson.ObjectId, line LogLine) error
+	// LogLines returns every log chunk persisted so far for uniqueID, in
+	// the order they were appended.
+	LogLines(uniqueID bson.ObjectId) ([]LogLine, error)
+}
+
+var (
+	storagesMu sync.RWMutex
+	storages   = make(map[string]Storage)
+
+	storageMu      sync.RWMutex
+	currentStorage Storage
+)
+
+// RegisterStorage makes a Storage implementation available under name, so
+// it can later be selected with SetStorage. It is meant to be called from
+// the init function of packages providing alternative backends (see
+// mongoStorage in this package for the reference implementation).
+func RegisterStorage(name string, storage Storage) {
+	storagesMu.Lock()
+	defer storagesMu.Unlock()
+	storages[name] = storage
+}
+
+// GetStorage returns the Storage implementation previously registered
+// under name, or an error if none was registered.
+func GetStorage(name string) (Storage, error) {
+	storagesMu.RLock()
+	defer storagesMu.RUnlock()
+	storage, ok := storages[name]
+	if !ok {
+		return nil, fmt.Errorf("event: unknown storage %q", name)
+	}
+	return storage, nil
+}
+
+// SetStorage overrides the Storage implementation used by every function
+// in this package. It defaults to the Mongo backed implementation, kept
+// for backward compatibility with existing deployments.
+func SetStorage(storage Storage) {
+	storageMu.Lock()
+	defer storageMu.Unlock()
+	currentStorage = storage
+}
+
+func getStorage() Storage {
+	storageMu.RLock()
+	defer storageMu.RUnlock()
+	if currentStorage == nil {
+		return defaultMongoStorage
+	}
+	return currentStorage
+}
+
+func init() {
+	RegisterStorage("mongodb", defaultMongoStorage)
+}
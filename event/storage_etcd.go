@@ -0,0 +1,419 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	etcd "go.etcd.io/etcd/clientv3"
+)
+
+// etcdKeyPrefix is the namespace under which every key written by
+// etcdStorage lives, so the events tree can share an etcd cluster with
+// other tsuru subsystems.
+const etcdKeyPrefix = "/tsuru/events/"
+
+// ErrEtcdDup is returned by etcdStorage.Insert when a key already exists
+// for the event target, mirroring the semantics of a MongoDB duplicate
+// key error.
+var ErrEtcdDup = fmt.Errorf("event: target already locked")
+
+// etcdStorage is an alternative Storage implementation backed by an
+// etcd v3 cluster, allowing tsuru to be deployed without MongoDB.
+// Running events are stored as regular keys under etcdKeyPrefix, keyed
+// by the target; finished events are additionally indexed by their
+// UniqueID so GetByID keeps working after the running key is removed.
+type etcdStorage struct {
+	client *etcd.Client
+}
+
+// NewEtcdStorage creates a Storage implementation on top of an already
+// connected etcd v3 client. Callers typically register it with
+// event.RegisterStorage and select it with event.SetStorage.
+func NewEtcdStorage(client *etcd.Client) Storage {
+	return &etcdStorage{client: client}
+}
+
+func (s *etcdStorage) runningKey(id eventId) string {
+	return etcdKeyPrefix + "running/" + id.Target.Name + "/" + id.Target.Value
+}
+
+func (s *etcdStorage) finishedKey(uniqueID bson.ObjectId) string {
+	return etcdKeyPrefix + "finished/" + uniqueID.Hex()
+}
+
+// throttledKey indexes every event that starts for a target under a
+// lexically time-ordered key, so CountThrottled can range over a
+// window without needing to load the target's current or finished
+// events. The key survives the event finishing and being removed from
+// runningKey/finishedKey, so throttle counts keep working across the
+// whole window, not just while the event is running.
+func (s *etcdStorage) throttledKey(target Target, startTime time.Time, uniqueID bson.ObjectId) string {
+	return fmt.Sprintf("%sthrottled/%s/%s/%020d-%s", etcdKeyPrefix, target.Name, target.Value,
+		startTime.UnixNano(), uniqueID.Hex())
+}
+
+type throttledEntry struct {
+	KindName  string
+	StartTime time.Time
+}
+
+func (s *etcdStorage) Insert(evt *eventData) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	throttledData, err := json.Marshal(throttledEntry{KindName: evt.Kind.Name, StartTime: evt.StartTime})
+	if err != nil {
+		return err
+	}
+	key := s.runningKey(evt.ID)
+	txn := s.client.Txn(ctx).
+		If(etcd.Compare(etcd.CreateRevision(key), "=", 0)).
+		Then(
+			etcd.OpPut(key, string(data)),
+			etcd.OpPut(s.throttledKey(evt.ID.Target, evt.StartTime, evt.UniqueID), string(throttledData)),
+		)
+	resp, err := txn.Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrEtcdDup
+	}
+	return nil
+}
+
+func (s *etcdStorage) IsDup(err error) bool {
+	return err == ErrEtcdDup
+}
+
+func (s *etcdStorage) FindByTarget(id eventId) (*eventData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := s.client.Get(ctx, s.runningKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrEventNotFound
+	}
+	var evt eventData
+	if err = json.Unmarshal(resp.Kvs[0].Value, &evt); err != nil {
+		return nil, err
+	}
+	return &evt, nil
+}
+
+func (s *etcdStorage) FindByID(uniqueID bson.ObjectId) (*eventData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := s.client.Get(ctx, s.finishedKey(uniqueID))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		// Not finished yet: running events are keyed by target, so look
+		// for the one carrying uniqueID.
+		resp, err = s.client.Get(ctx, etcdKeyPrefix+"running/", etcd.WithPrefix())
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			var evt eventData
+			if err = json.Unmarshal(kv.Value, &evt); err == nil && evt.UniqueID == uniqueID {
+				return &evt, nil
+			}
+		}
+		return nil, ErrEventNotFound
+	}
+	var evt eventData
+	if err = json.Unmarshal(resp.Kvs[0].Value, &evt); err != nil {
+		return nil, err
+	}
+	return &evt, nil
+}
+
+func (s *etcdStorage) FindRunning(target Target, kind string) (*eventData, error) {
+	evt, err := s.FindByTarget(eventId{Target: target})
+	if err != nil {
+		return nil, err
+	}
+	if !evt.Running || evt.Kind.Name != kind {
+		return nil, ErrEventNotFound
+	}
+	return evt, nil
+}
+
+func (s *etcdStorage) List(filter *Filter) ([]eventData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	limit := 100
+	skip := 0
+	sort := "-starttime"
+	if filter != nil {
+		if filter.Limit != 0 {
+			limit = filter.Limit
+		}
+		if filter.Sort != "" {
+			sort = filter.Sort
+		}
+		if filter.Skip > 0 {
+			skip = filter.Skip
+		}
+	}
+	var all []eventData
+	for _, prefix := range []string{etcdKeyPrefix + "running/", etcdKeyPrefix + "finished/"} {
+		resp, err := s.client.Get(ctx, prefix, etcd.WithPrefix())
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			var evt eventData
+			if err = json.Unmarshal(kv.Value, &evt); err != nil {
+				return nil, err
+			}
+			if filter == nil || filterMatches(filter, &evt) {
+				all = append(all, evt)
+			}
+		}
+	}
+	sortEvents(all, sort)
+	if skip > 0 {
+		if skip >= len(all) {
+			return nil, nil
+		}
+		all = all[skip:]
+	}
+	if limit > 0 && limit < len(all) {
+		all = all[:limit]
+	}
+	return all, nil
+}
+
+// sortEvents orders events in place to mirror mongoStorage.List's
+// Sort(sort), which passes the same string straight to mgo. etcd has
+// no query-time sort, so List gathers everything first and sorts the
+// in-memory slice; only the starttime/endtime fields used by callers
+// today are supported.
+func sortEvents(all []eventData, sortSpec string) {
+	desc := strings.HasPrefix(sortSpec, "-")
+	field := strings.TrimPrefix(sortSpec, "-")
+	var key func(eventData) time.Time
+	switch field {
+	case "endtime":
+		key = func(e eventData) time.Time { return e.EndTime }
+	default:
+		key = func(e eventData) time.Time { return e.StartTime }
+	}
+	less := func(i, j int) bool { return key(all[i]).Before(key(all[j])) }
+	if desc {
+		asc := less
+		less = func(i, j int) bool { return asc(j, i) }
+	}
+	sort.Slice(all, less)
+}
+
+// filterMatches evaluates a Filter against a single event loaded from
+// etcd, since etcd has no query language equivalent to toQuery.
+func filterMatches(f *Filter, evt *eventData) bool {
+	if f.Target.Name != "" && f.Target.Name != evt.Target.Name {
+		return false
+	}
+	if f.Target.Value != "" && f.Target.Value != evt.Target.Value {
+		return false
+	}
+	if f.KindType != "" && f.KindType != evt.Kind.Type {
+		return false
+	}
+	if f.KindName != "" && f.KindName != evt.Kind.Name {
+		return false
+	}
+	if f.OwnerType != "" && f.OwnerType != evt.Owner.Type {
+		return false
+	}
+	if f.OwnerName != "" && f.OwnerName != evt.Owner.Name {
+		return false
+	}
+	if !f.Since.IsZero() && evt.StartTime.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && evt.StartTime.After(f.Until) {
+		return false
+	}
+	if !f.EndSince.IsZero() && evt.EndTime.Before(f.EndSince) {
+		return false
+	}
+	if f.Running != nil && *f.Running != evt.Running {
+		return false
+	}
+	if !f.IncludeRemoved && !evt.RemoveDate.IsZero() {
+		return false
+	}
+	return true
+}
+
+func (s *etcdStorage) MarkRemoved(target Target) error {
+	evt, err := s.FindByTarget(eventId{Target: target})
+	if err != nil {
+		if err == ErrEventNotFound {
+			return nil
+		}
+		return err
+	}
+	evt.RemoveDate = time.Now().UTC()
+	return s.put(s.runningKey(eventId{Target: target}), evt)
+}
+
+func (s *etcdStorage) RefreshLocks(targets []Target) error {
+	for _, t := range targets {
+		evt, err := s.FindByTarget(eventId{Target: t})
+		if err != nil {
+			if err == ErrEventNotFound {
+				continue
+			}
+			return err
+		}
+		evt.LockUpdateTime = time.Now().UTC()
+		if err = s.put(s.runningKey(eventId{Target: t}), evt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *etcdStorage) Remove(id eventId) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := s.client.Delete(ctx, s.runningKey(id))
+	return err
+}
+
+func (s *etcdStorage) Update(id eventId, evt *eventData) error {
+	if err := s.Remove(id); err != nil {
+		return err
+	}
+	return s.put(s.finishedKey(evt.UniqueID), evt)
+}
+
+func (s *etcdStorage) UpdateOther(id eventId, data interface{}) error {
+	evt, err := s.FindByTarget(id)
+	if err != nil {
+		return err
+	}
+	evt.OtherCustomData = data
+	return s.put(s.runningKey(id), evt)
+}
+
+func (s *etcdStorage) UpdateCancelInfo(id eventId, info cancelInfo, requireAsked bool) (*eventData, error) {
+	evt, err := s.FindByTarget(id)
+	if err != nil {
+		return nil, err
+	}
+	if requireAsked {
+		if !evt.CancelInfo.Asked {
+			return nil, ErrEventNotFound
+		}
+		evt.CancelInfo.AckTime = info.AckTime
+		evt.CancelInfo.Canceled = info.Canceled
+	} else {
+		evt.CancelInfo = info
+	}
+	if err = s.put(s.runningKey(id), evt); err != nil {
+		return nil, err
+	}
+	return evt, nil
+}
+
+// CountThrottled counts events started for target since the given time
+// by ranging over the throttledKey index, rather than only looking at
+// the currently running event. This lets etcd storage enforce throttle
+// limits greater than 1 the same way mongoStorage does.
+func (s *etcdStorage) CountThrottled(target Target, kindName string, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	prefix := fmt.Sprintf("%sthrottled/%s/%s/", etcdKeyPrefix, target.Name, target.Value)
+	resp, err := s.client.Get(ctx, prefix, etcd.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, kv := range resp.Kvs {
+		var entry throttledEntry
+		if err = json.Unmarshal(kv.Value, &entry); err != nil {
+			return 0, err
+		}
+		if kindName != "" && entry.KindName != kindName {
+			continue
+		}
+		if entry.StartTime.Before(since) {
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (s *etcdStorage) logKey(uniqueID bson.ObjectId) string {
+	return etcdKeyPrefix + "logs/" + uniqueID.Hex()
+}
+
+// AppendLog stores the whole accumulated log line slice under a single
+// key on every call, since etcd has no analogue to Mongo's per-chunk
+// documents. This is fine for the size of a typical deploy log, but
+// unlike mongoStorage it rewrites the whole history on every line; a
+// dedicated per-chunk key scheme would be needed to scale this further.
+func (s *etcdStorage) AppendLog(uniqueID bson.ObjectId, line LogLine) error {
+	lines, err := s.LogLines(uniqueID)
+	if err != nil {
+		return err
+	}
+	lines = append(lines, line)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	data, err := json.Marshal(lines)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Put(ctx, s.logKey(uniqueID), string(data))
+	return err
+}
+
+func (s *etcdStorage) LogLines(uniqueID bson.ObjectId) ([]LogLine, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := s.client.Get(ctx, s.logKey(uniqueID))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	var lines []LogLine
+	if err = json.Unmarshal(resp.Kvs[0].Value, &lines); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+func (s *etcdStorage) put(key string, evt *eventData) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	data, err := json.Marshal(evt)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.Put(ctx, key, string(data))
+	return err
+}
@@ -0,0 +1,180 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"testing"
+	"time"
+
+	etcd "go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/integration"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// newTestEtcdClient spins up a single-node embedded etcd cluster for the
+// duration of the test, mirroring how the rest of tsuru exercises its
+// etcd-backed code against the real wire protocol instead of a mock.
+func newTestEtcdClient(t *testing.T) (*etcd.Client, func()) {
+	if testing.Short() {
+		t.Skip("skipping etcd-backed test in short mode")
+	}
+	cluster := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	return cluster.RandClient(), func() { cluster.Terminate(t) }
+}
+
+func TestEtcdStorageInsertIsDupAndFindByTarget(t *testing.T) {
+	client, teardown := newTestEtcdClient(t)
+	defer teardown()
+	storage := NewEtcdStorage(client)
+
+	target := Target{Name: "app", Value: "myapp"}
+	evt := &eventData{
+		ID:        eventId{Target: target},
+		UniqueID:  bson.NewObjectId(),
+		Target:    target,
+		Kind:      kind{Type: KindTypeInternal, Name: "healer"},
+		Running:   true,
+		StartTime: time.Now().UTC(),
+	}
+	if err := storage.Insert(evt); err != nil {
+		t.Fatalf("unexpected error inserting: %s", err)
+	}
+	err := storage.Insert(evt)
+	if err == nil || !storage.IsDup(err) {
+		t.Fatalf("expected a duplicate error on the second insert, got: %v", err)
+	}
+
+	found, err := storage.FindByTarget(eventId{Target: target})
+	if err != nil {
+		t.Fatalf("unexpected error finding by target: %s", err)
+	}
+	if found.UniqueID != evt.UniqueID {
+		t.Fatalf("expected to find the inserted event, got %#v", found)
+	}
+}
+
+func TestEtcdStorageUpdateMovesEventToFinished(t *testing.T) {
+	client, teardown := newTestEtcdClient(t)
+	defer teardown()
+	storage := NewEtcdStorage(client)
+
+	target := Target{Name: "app", Value: "myapp"}
+	id := eventId{Target: target}
+	evt := &eventData{
+		ID:        id,
+		UniqueID:  bson.NewObjectId(),
+		Target:    target,
+		Kind:      kind{Type: KindTypeInternal, Name: "healer"},
+		Running:   true,
+		StartTime: time.Now().UTC(),
+	}
+	if err := storage.Insert(evt); err != nil {
+		t.Fatalf("unexpected error inserting: %s", err)
+	}
+	evt.Running = false
+	evt.EndTime = time.Now().UTC()
+	if err := storage.Update(id, evt); err != nil {
+		t.Fatalf("unexpected error updating: %s", err)
+	}
+	if _, err := storage.FindByTarget(id); err != ErrEventNotFound {
+		t.Fatalf("expected the running record to be gone, got: %v", err)
+	}
+	found, err := storage.FindByID(evt.UniqueID)
+	if err != nil {
+		t.Fatalf("unexpected error finding by id: %s", err)
+	}
+	if found.Running {
+		t.Fatal("expected the finished event to no longer be running")
+	}
+}
+
+func TestEtcdStorageCountThrottledCountsPastWindow(t *testing.T) {
+	client, teardown := newTestEtcdClient(t)
+	defer teardown()
+	storage := NewEtcdStorage(client)
+
+	target := Target{Name: "app", Value: "myapp"}
+	since := time.Now().UTC().Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		id := eventId{Target: target, ObjId: bson.NewObjectId()}
+		evt := &eventData{
+			ID:        id,
+			UniqueID:  bson.NewObjectId(),
+			Target:    target,
+			Kind:      kind{Type: KindTypeInternal, Name: "healer"},
+			Running:   false,
+			StartTime: time.Now().UTC(),
+			EndTime:   time.Now().UTC(),
+		}
+		if err := storage.Insert(evt); err != nil {
+			t.Fatalf("unexpected error inserting event %d: %s", i, err)
+		}
+		if err := storage.Update(id, evt); err != nil {
+			t.Fatalf("unexpected error finishing event %d: %s", i, err)
+		}
+	}
+
+	count, err := storage.CountThrottled(target, "healer", since)
+	if err != nil {
+		t.Fatalf("unexpected error counting throttled events: %s", err)
+	}
+	if count != 3 {
+		t.Fatalf("expected all 3 finished events to count towards the throttle window, got %d", count)
+	}
+
+	count, err = storage.CountThrottled(target, "healer", time.Now().UTC().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error counting throttled events: %s", err)
+	}
+	if count != 0 {
+		t.Fatalf("expected no events to count for a window starting in the future, got %d", count)
+	}
+}
+
+func TestEtcdStorageListHonorsLimitSkipAndSort(t *testing.T) {
+	client, teardown := newTestEtcdClient(t)
+	defer teardown()
+	storage := NewEtcdStorage(client)
+
+	target := Target{Name: "app", Value: "myapp"}
+	base := time.Now().UTC()
+	for i := 0; i < 5; i++ {
+		id := eventId{Target: target, ObjId: bson.NewObjectId()}
+		evt := &eventData{
+			ID:        id,
+			UniqueID:  bson.NewObjectId(),
+			Target:    target,
+			Kind:      kind{Type: KindTypeInternal, Name: "healer"},
+			Running:   false,
+			StartTime: base.Add(time.Duration(i) * time.Minute),
+			EndTime:   base.Add(time.Duration(i) * time.Minute),
+		}
+		if err := storage.Insert(evt); err != nil {
+			t.Fatalf("unexpected error inserting event %d: %s", i, err)
+		}
+		if err := storage.Update(id, evt); err != nil {
+			t.Fatalf("unexpected error finishing event %d: %s", i, err)
+		}
+	}
+
+	all, err := storage.List(&Filter{Limit: 2, Sort: "starttime"})
+	if err != nil {
+		t.Fatalf("unexpected error listing: %s", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("expected Limit to cap the result at 2, got %d", len(all))
+	}
+	if !all[0].StartTime.Equal(base) {
+		t.Fatalf("expected ascending sort to return the oldest event first, got %v", all[0].StartTime)
+	}
+
+	skipped, err := storage.List(&Filter{Limit: 2, Skip: 1, Sort: "starttime"})
+	if err != nil {
+		t.Fatalf("unexpected error listing with skip: %s", err)
+	}
+	if len(skipped) != 2 || skipped[0].StartTime.Equal(base) {
+		t.Fatalf("expected Skip to move past the oldest event, got %#v", skipped)
+	}
+}
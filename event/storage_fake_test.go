@@ -0,0 +1,233 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// errFakeDup is returned by fakeStorage.Insert when a running record
+// already exists for the target, mirroring a MongoDB duplicate key error.
+var errFakeDup = fmt.Errorf("fake: target already locked")
+
+// fakeStorage is an in-memory Storage used by tests that exercise newEvt's
+// locking and self-healing logic without a real MongoDB or etcd cluster.
+// mu guards every field below: tests that change running/finished while
+// background goroutines started by streamLog and similar code under test
+// may be reading them (e.g. to simulate another process finishing an
+// event) must go through the helper methods below, so they stay
+// race-free. Seeding the maps directly before any such goroutine starts
+// needs no lock.
+type fakeStorage struct {
+	mu       sync.Mutex
+	running  map[Target]eventData
+	finished map[bson.ObjectId]eventData
+	logs     map[bson.ObjectId][]LogLine
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{
+		running:  make(map[Target]eventData),
+		finished: make(map[bson.ObjectId]eventData),
+		logs:     make(map[bson.ObjectId][]LogLine),
+	}
+}
+
+// putRunning and finishRunning let tests mutate the fake under the same
+// lock used by the Storage methods, instead of writing to the maps
+// directly.
+func (s *fakeStorage) putRunning(evt eventData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running[evt.ID.Target] = evt
+}
+
+func (s *fakeStorage) finishRunning(target Target, evt eventData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, target)
+	s.finished[evt.UniqueID] = evt
+}
+
+func (s *fakeStorage) Insert(evt *eventData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.running[evt.ID.Target]; ok {
+		return errFakeDup
+	}
+	s.running[evt.ID.Target] = *evt
+	return nil
+}
+
+func (s *fakeStorage) IsDup(err error) bool {
+	return err == errFakeDup
+}
+
+func (s *fakeStorage) FindByTarget(id eventId) (*eventData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	evt, ok := s.running[id.Target]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+	return &evt, nil
+}
+
+func (s *fakeStorage) FindByID(uniqueID bson.ObjectId) (*eventData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, evt := range s.running {
+		if evt.UniqueID == uniqueID {
+			return &evt, nil
+		}
+	}
+	if evt, ok := s.finished[uniqueID]; ok {
+		return &evt, nil
+	}
+	return nil, ErrEventNotFound
+}
+
+func (s *fakeStorage) FindRunning(target Target, kind string) (*eventData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	evt, ok := s.running[target]
+	if !ok || evt.Kind.Name != kind {
+		return nil, ErrEventNotFound
+	}
+	return &evt, nil
+}
+
+func (s *fakeStorage) List(filter *Filter) ([]eventData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []eventData
+	for _, evt := range s.running {
+		all = append(all, evt)
+	}
+	for _, evt := range s.finished {
+		all = append(all, evt)
+	}
+	if filter == nil {
+		return all, nil
+	}
+	var matched []eventData
+	for i := range all {
+		if filterMatches(filter, &all[i]) {
+			matched = append(matched, all[i])
+		}
+	}
+	return matched, nil
+}
+
+func (s *fakeStorage) MarkRemoved(target Target) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	if evt, ok := s.running[target]; ok {
+		evt.RemoveDate = now
+		s.running[target] = evt
+	}
+	for id, evt := range s.finished {
+		if evt.Target == target {
+			evt.RemoveDate = now
+			s.finished[id] = evt
+		}
+	}
+	return nil
+}
+
+func (s *fakeStorage) RefreshLocks(targets []Target) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range targets {
+		if evt, ok := s.running[t]; ok {
+			evt.LockUpdateTime = time.Now().UTC()
+			s.running[t] = evt
+		}
+	}
+	return nil
+}
+
+func (s *fakeStorage) Remove(id eventId) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, id.Target)
+	return nil
+}
+
+func (s *fakeStorage) Update(id eventId, evt *eventData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, id.Target)
+	s.finished[evt.UniqueID] = *evt
+	return nil
+}
+
+func (s *fakeStorage) UpdateOther(id eventId, data interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	evt, ok := s.running[id.Target]
+	if !ok {
+		return ErrEventNotFound
+	}
+	evt.OtherCustomData = data
+	s.running[id.Target] = evt
+	return nil
+}
+
+func (s *fakeStorage) UpdateCancelInfo(id eventId, info cancelInfo, requireAsked bool) (*eventData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	evt, ok := s.running[id.Target]
+	if !ok {
+		return nil, ErrEventNotFound
+	}
+	if requireAsked {
+		if !evt.CancelInfo.Asked {
+			return nil, ErrEventNotFound
+		}
+		evt.CancelInfo.AckTime = info.AckTime
+		evt.CancelInfo.Canceled = info.Canceled
+	} else {
+		evt.CancelInfo = info
+	}
+	s.running[id.Target] = evt
+	return &evt, nil
+}
+
+func (s *fakeStorage) CountThrottled(target Target, kindName string, since time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, evt := range s.finished {
+		if evt.Target != target {
+			continue
+		}
+		if kindName != "" && evt.Kind.Name != kindName {
+			continue
+		}
+		if evt.StartTime.After(since) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *fakeStorage) AppendLog(uniqueID bson.ObjectId, line LogLine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logs[uniqueID] = append(s.logs[uniqueID], line)
+	return nil
+}
+
+func (s *fakeStorage) LogLines(uniqueID bson.ObjectId) ([]LogLine, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logs[uniqueID], nil
+}
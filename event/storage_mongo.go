@@ -0,0 +1,276 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"time"
+
+	"github.com/tsuru/tsuru/db"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// defaultMongoStorage is the Storage implementation backed by MongoDB. It
+// preserves the exact queries tsuru has always used against the events
+// collection, and remains the default Storage until an operator opts into
+// an alternative backend with SetStorage.
+var defaultMongoStorage Storage = mongoStorage{}
+
+type mongoStorage struct{}
+
+// IsDup reports whether err is a MongoDB duplicate key error, meaning an
+// event already holds the lock for a given target.
+func (mongoStorage) IsDup(err error) bool {
+	return mgo.IsDup(err)
+}
+
+func (mongoStorage) Insert(evt *eventData) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Events().Insert(evt)
+}
+
+func (mongoStorage) FindByTarget(id eventId) (*eventData, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var evt eventData
+	err = conn.Events().FindId(id).One(&evt)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrEventNotFound
+		}
+		return nil, err
+	}
+	return &evt, nil
+}
+
+func (mongoStorage) FindByID(uniqueID bson.ObjectId) (*eventData, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var evt eventData
+	err = conn.Events().Find(bson.M{"uniqueid": uniqueID}).One(&evt)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrEventNotFound
+		}
+		return nil, err
+	}
+	return &evt, nil
+}
+
+func (mongoStorage) FindRunning(target Target, kind string) (*eventData, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var evt eventData
+	err = conn.Events().Find(bson.M{
+		"_id":       eventId{Target: target},
+		"kind.name": kind,
+		"running":   true,
+	}).One(&evt)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrEventNotFound
+		}
+		return nil, err
+	}
+	return &evt, nil
+}
+
+func (mongoStorage) List(filter *Filter) ([]eventData, error) {
+	limit := 100
+	skip := 0
+	var query bson.M
+	sort := "-starttime"
+	if filter != nil {
+		if filter.Limit != 0 {
+			limit = filter.Limit
+		}
+		if filter.Sort != "" {
+			sort = filter.Sort
+		}
+		if filter.Skip > 0 {
+			skip = filter.Skip
+		}
+		query = filter.toQuery()
+	}
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	find := conn.Events().Find(query).Sort(sort)
+	if limit > 0 {
+		find = find.Limit(limit)
+	}
+	if skip > 0 {
+		find = find.Skip(skip)
+	}
+	var allData []eventData
+	err = find.All(&allData)
+	if err != nil {
+		return nil, err
+	}
+	return allData, nil
+}
+
+func (mongoStorage) MarkRemoved(target Target) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	now := time.Now().UTC()
+	_, err = conn.Events().UpdateAll(bson.M{
+		"target":     target,
+		"removedate": bson.M{"$exists": false},
+	}, bson.M{"$set": bson.M{"removedate": now}})
+	return err
+}
+
+func (mongoStorage) RefreshLocks(targets []Target) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ids := make([]interface{}, len(targets))
+	for i, t := range targets {
+		ids[i], _ = (eventId{Target: t}).GetBSON()
+	}
+	_, err = conn.Events().UpdateAll(bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"lockupdatetime": time.Now().UTC()}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (mongoStorage) Remove(id eventId) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Events().RemoveId(id)
+}
+
+func (mongoStorage) Update(id eventId, evt *eventData) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer conn.Events().RemoveId(id)
+	return conn.Events().Insert(evt)
+}
+
+func (mongoStorage) UpdateOther(id eventId, data interface{}) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Events().UpdateId(id, bson.M{
+		"$set": bson.M{"othercustomdata": data},
+	})
+}
+
+func (mongoStorage) UpdateCancelInfo(id eventId, info cancelInfo, requireAsked bool) (*eventData, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var update bson.M
+	var query bson.M
+	if requireAsked {
+		update = bson.M{"$set": bson.M{
+			"cancelinfo.acktime":  info.AckTime,
+			"cancelinfo.canceled": info.Canceled,
+		}}
+		query = bson.M{"_id": id, "cancelinfo.asked": true}
+	} else {
+		update = bson.M{"$set": bson.M{"cancelinfo": info}}
+		query = bson.M{"_id": id}
+	}
+	change := mgo.Change{Update: update, ReturnNew: true}
+	var evt eventData
+	_, err = conn.Events().Find(query).Apply(change, &evt)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, ErrEventNotFound
+		}
+		return nil, err
+	}
+	return &evt, nil
+}
+
+// logLineDoc is a single chunk of an event's log stream, stored in the
+// event_logs collection so a crashed process doesn't lose everything
+// buffered in e.logBuffer since the event started.
+type logLineDoc struct {
+	UniqueID bson.ObjectId
+	Time     time.Time
+	Message  string
+}
+
+func (mongoStorage) AppendLog(uniqueID bson.ObjectId, line LogLine) error {
+	conn, err := db.Conn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Collection("event_logs").Insert(logLineDoc{
+		UniqueID: uniqueID,
+		Time:     line.Time,
+		Message:  line.Message,
+	})
+}
+
+func (mongoStorage) LogLines(uniqueID bson.ObjectId) ([]LogLine, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var docs []logLineDoc
+	err = conn.Collection("event_logs").Find(bson.M{"uniqueid": uniqueID}).Sort("$natural").All(&docs)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]LogLine, len(docs))
+	for i, d := range docs {
+		lines[i] = LogLine{Time: d.Time, Message: d.Message}
+	}
+	return lines, nil
+}
+
+func (mongoStorage) CountThrottled(target Target, kindName string, since time.Time) (int, error) {
+	conn, err := db.Conn()
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	query := bson.M{
+		"target.name":  target.Name,
+		"target.value": target.Value,
+		"starttime":    bson.M{"$gt": since},
+	}
+	if kindName != "" {
+		query["kind.name"] = kindName
+	}
+	return conn.Events().Find(query).Count()
+}
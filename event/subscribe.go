@@ -0,0 +1,277 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"fmt"
+
+	"github.com/tsuru/tsuru/log"
+)
+
+// EventAction identifies which transition produced an Event passed to a
+// Source, so a single stream can carry creations, completions and cancel
+// acknowledgements without three separate channels.
+type EventAction string
+
+const (
+	ActionCreate    = EventAction("create")
+	ActionDone      = EventAction("done")
+	ActionCancelAck = EventAction("cancelack")
+)
+
+// Source produces events for Subscribe to dispatch. Watch must return a
+// channel that is closed when the source can no longer produce events;
+// Close stops the source.
+type Source interface {
+	Watch() (<-chan SourceEvent, error)
+	Close() error
+}
+
+// SourceEvent pairs an Event with the action that produced it.
+type SourceEvent struct {
+	Action EventAction
+	Event  *Event
+}
+
+// Predicate decides whether a SourceEvent is relevant to a Handler. Match
+// is called once per event, in the subscription's own goroutine.
+type Predicate interface {
+	Match(*SourceEvent) bool
+}
+
+type predicateFunc func(*SourceEvent) bool
+
+func (f predicateFunc) Match(evt *SourceEvent) bool {
+	return f(evt)
+}
+
+// KindPredicate matches events whose kind name equals Name.
+type KindPredicate struct{ Name string }
+
+func (p KindPredicate) Match(evt *SourceEvent) bool {
+	return evt.Event.Kind.Name == p.Name
+}
+
+// TargetNamePredicate matches events whose target name equals Name.
+type TargetNamePredicate struct{ Name string }
+
+func (p TargetNamePredicate) Match(evt *SourceEvent) bool {
+	return evt.Event.Target.Name == p.Name
+}
+
+// OwnerTypePredicate matches events owned by the given owner type.
+type OwnerTypePredicate struct{ Type ownerType }
+
+func (p OwnerTypePredicate) Match(evt *SourceEvent) bool {
+	return evt.Event.Owner.Type == p.Type
+}
+
+// RunningPredicate matches events currently running.
+var RunningPredicate Predicate = predicateFunc(func(evt *SourceEvent) bool {
+	return evt.Event.Running
+})
+
+// And matches when every predicate in preds matches.
+func And(preds ...Predicate) Predicate {
+	return predicateFunc(func(evt *SourceEvent) bool {
+		for _, p := range preds {
+			if !p.Match(evt) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Or matches when any predicate in preds matches.
+func Or(preds ...Predicate) Predicate {
+	return predicateFunc(func(evt *SourceEvent) bool {
+		for _, p := range preds {
+			if p.Match(evt) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Not inverts p.
+func Not(p Predicate) Predicate {
+	return predicateFunc(func(evt *SourceEvent) bool {
+		return !p.Match(evt)
+	})
+}
+
+// Handler reacts to events that pass every Predicate given to Subscribe.
+// Implementations should return quickly; slow handlers apply backpressure
+// to the Subscription's bounded queue and can eventually cause events to
+// be dropped.
+type Handler interface {
+	OnCreate(evt *Event) error
+	OnDone(evt *Event) error
+	OnCancelAck(evt *Event) error
+}
+
+// subscriptionQueueSize bounds how many pending SourceEvents a Source
+// buffers for a Subscription; once the buffer is full, the Source drops
+// further events instead of blocking.
+const subscriptionQueueSize = 100
+
+// Subscription represents an active Subscribe call. Unsubscribe stops the
+// dispatch goroutine and releases the underlying Source.
+type Subscription interface {
+	Unsubscribe() error
+}
+
+type subscription struct {
+	source Source
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// Subscribe wires a Source to a Handler, invoking it for every SourceEvent
+// that matches all of preds. Dispatch happens in its own goroutine; the
+// queue between the Source and the Handler is bounded by
+// subscriptionQueueSize so a slow Handler cannot block event creation
+// indefinitely, at the cost of dropping events once the queue is full.
+func Subscribe(source Source, preds []Predicate, handler Handler) (Subscription, error) {
+	if source == nil {
+		source = NewLocalSource()
+	}
+	evtCh, err := source.Watch()
+	if err != nil {
+		return nil, err
+	}
+	sub := &subscription{
+		source: source,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go sub.dispatch(evtCh, preds, handler)
+	return sub, nil
+}
+
+func (s *subscription) dispatch(evtCh <-chan SourceEvent, preds []Predicate, handler Handler) {
+	defer close(s.doneCh)
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case evt, ok := <-evtCh:
+			if !ok {
+				return
+			}
+			if !matchAll(preds, &evt) {
+				continue
+			}
+			if err := dispatchOne(handler, &evt); err != nil {
+				log.Errorf("[events] [subscribe] error handling %s event for %v: %s", evt.Action, evt.Event, err)
+			}
+		}
+	}
+}
+
+func matchAll(preds []Predicate, evt *SourceEvent) bool {
+	for _, p := range preds {
+		if !p.Match(evt) {
+			return false
+		}
+	}
+	return true
+}
+
+func dispatchOne(handler Handler, evt *SourceEvent) error {
+	switch evt.Action {
+	case ActionCreate:
+		return handler.OnCreate(evt.Event)
+	case ActionDone:
+		return handler.OnDone(evt.Event)
+	case ActionCancelAck:
+		return handler.OnCancelAck(evt.Event)
+	default:
+		return fmt.Errorf("unknown event action %q", evt.Action)
+	}
+}
+
+func (s *subscription) Unsubscribe() error {
+	close(s.stopCh)
+	<-s.doneCh
+	return s.source.Close()
+}
+
+// dispatchers broadcasts the events published from newEvt, done and
+// AckCancel to the channel of every watching localSource, so in-process
+// events reach subscribers without requiring a Mongo tailable cursor. It
+// is the in-process equivalent of mongoSource (subscribe_mongo.go),
+// and is always active regardless of which Source implementations callers
+// additionally subscribe to.
+var dispatchers = newBroadcaster()
+
+type broadcaster struct {
+	subs      map[chan SourceEvent]struct{}
+	addCh     chan chan SourceEvent
+	removeCh  chan chan SourceEvent
+	publishCh chan SourceEvent
+}
+
+func newBroadcaster() *broadcaster {
+	b := &broadcaster{
+		subs:      map[chan SourceEvent]struct{}{},
+		addCh:     make(chan chan SourceEvent),
+		removeCh:  make(chan chan SourceEvent),
+		publishCh: make(chan SourceEvent),
+	}
+	go b.run()
+	return b
+}
+
+func (b *broadcaster) run() {
+	for {
+		select {
+		case ch := <-b.addCh:
+			b.subs[ch] = struct{}{}
+		case ch := <-b.removeCh:
+			delete(b.subs, ch)
+			close(ch)
+		case evt := <-b.publishCh:
+			for ch := range b.subs {
+				select {
+				case ch <- evt:
+				default:
+					log.Errorf("[events] [subscribe] dropping event for %v, subscriber queue is full", evt.Event)
+				}
+			}
+		}
+	}
+}
+
+func (b *broadcaster) publish(action EventAction, evt *Event) {
+	b.publishCh <- SourceEvent{Action: action, Event: evt}
+}
+
+// localSource is a Source backed by the in-process broadcaster fed
+// directly from newEvt/done, so subscribers don't depend on polling
+// Mongo. It is what Subscribe uses when no external Source is given.
+type localSource struct {
+	ch chan SourceEvent
+}
+
+// NewLocalSource returns a Source that receives every event created or
+// finished by this process, dispatched from inside newEvt and done. It
+// requires no external watch mechanism and is the recommended Source for
+// in-process subscribers such as auditing or webhooks.
+func NewLocalSource() Source {
+	return &localSource{ch: make(chan SourceEvent, subscriptionQueueSize)}
+}
+
+func (s *localSource) Watch() (<-chan SourceEvent, error) {
+	dispatchers.addCh <- s.ch
+	return s.ch, nil
+}
+
+func (s *localSource) Close() error {
+	dispatchers.removeCh <- s.ch
+	return nil
+}
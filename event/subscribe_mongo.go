@@ -0,0 +1,100 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"time"
+
+	"github.com/tsuru/tsuru/log"
+)
+
+// mongoPollInterval controls how often mongoSource re-scans the events
+// collection for new or finished events. The events collection is not
+// capped, so a true tailable cursor isn't available; polling the last
+// seen timestamps is the cheapest approximation that still works across
+// multiple tsuru API processes sharing the same Mongo replica set.
+var mongoPollInterval = 2 * time.Second
+
+// mongoSource implements Source on top of the events collection, for
+// deployments that want Subscribe to observe events created by every
+// tsuru API process rather than just the local one (see localSource for
+// the in-process alternative).
+type mongoSource struct {
+	stopCh chan struct{}
+}
+
+// NewMongoSource returns a Source that periodically polls the events
+// collection for newly created and newly finished events.
+func NewMongoSource() Source {
+	return &mongoSource{}
+}
+
+func (s *mongoSource) Watch() (<-chan SourceEvent, error) {
+	s.stopCh = make(chan struct{})
+	ch := make(chan SourceEvent, subscriptionQueueSize)
+	go s.poll(ch)
+	return ch, nil
+}
+
+func (s *mongoSource) poll(ch chan<- SourceEvent) {
+	defer close(ch)
+	lastStart := time.Now().UTC()
+	lastEnd := lastStart
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-time.After(mongoPollInterval):
+		}
+		created, err := List(&Filter{Since: lastStart, Running: boolPtr(true)})
+		if err != nil {
+			log.Errorf("[events] [subscribe] error polling for created events: %s", err)
+			continue
+		}
+		for i := range created {
+			lastStart = advanceWatermark(lastStart, created[i].StartTime)
+			s.send(ch, ActionCreate, &created[i])
+		}
+		finished, err := List(&Filter{EndSince: lastEnd, Running: boolPtr(false)})
+		if err != nil {
+			log.Errorf("[events] [subscribe] error polling for finished events: %s", err)
+			continue
+		}
+		for i := range finished {
+			lastEnd = advanceWatermark(lastEnd, finished[i].EndTime)
+			s.send(ch, ActionDone, &finished[i])
+		}
+	}
+}
+
+func (s *mongoSource) send(ch chan<- SourceEvent, action EventAction, evt *Event) {
+	select {
+	case ch <- SourceEvent{Action: action, Event: evt}:
+	default:
+		log.Errorf("[events] [subscribe] dropping %s event for %v, queue is full", action, evt)
+	}
+}
+
+func (s *mongoSource) Close() error {
+	close(s.stopCh)
+	return nil
+}
+
+// advanceWatermark returns the next value for a poll watermark after an
+// event at seen was matched by a $gte query against current. It must
+// move strictly past seen, not just past current, since the query is
+// inclusive: an event exactly at the watermark would otherwise match
+// again on every future poll and never advance it, causing infinite
+// redelivery on an exact timestamp collision.
+func advanceWatermark(current, seen time.Time) time.Time {
+	if !seen.Before(current) {
+		return seen.Add(time.Nanosecond)
+	}
+	return current
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
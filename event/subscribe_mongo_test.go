@@ -0,0 +1,88 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestMongoSourcePollFiltersByEndTime guards against filtering finished
+// events by StartTime instead of EndTime: a long running event started
+// well before the last poll, but finished after it, must still be
+// reported exactly once.
+func TestMongoSourcePollFiltersByEndTime(t *testing.T) {
+	store := newFakeStorage()
+	SetStorage(store)
+	defer SetStorage(nil)
+
+	longRunningStart := time.Now().UTC().Add(-time.Hour)
+	lastEnd := time.Now().UTC().Add(-time.Minute)
+
+	longRunning := eventData{
+		UniqueID:  bson.NewObjectId(),
+		Target:    Target{Name: "app", Value: "longrunning"},
+		StartTime: longRunningStart,
+		EndTime:   time.Now().UTC(),
+		Running:   false,
+	}
+	alreadySeen := eventData{
+		UniqueID:  bson.NewObjectId(),
+		Target:    Target{Name: "app", Value: "alreadyseen"},
+		StartTime: time.Now().UTC().Add(-2 * time.Hour),
+		EndTime:   lastEnd.Add(-time.Second),
+		Running:   false,
+	}
+	store.finished[longRunning.UniqueID] = longRunning
+	store.finished[alreadySeen.UniqueID] = alreadySeen
+
+	finished, err := List(&Filter{EndSince: lastEnd, Running: boolPtr(false)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(finished) != 1 {
+		t.Fatalf("expected exactly one finished event, got %d", len(finished))
+	}
+	if finished[0].Target.Value != "longrunning" {
+		t.Fatalf("expected the long running event to be reported, got %v", finished[0].Target)
+	}
+}
+
+// TestAdvanceWatermarkPastExactCollision guards against the watermark
+// getting stuck on an event whose timestamp exactly matches it: since
+// List uses an inclusive $gte, such an event would otherwise be
+// redelivered on every subsequent poll forever.
+func TestAdvanceWatermarkPastExactCollision(t *testing.T) {
+	watermark := time.Now().UTC()
+	next := advanceWatermark(watermark, watermark)
+	if !next.After(watermark) {
+		t.Fatalf("expected an event exactly at the watermark to push it forward, got %v", next)
+	}
+}
+
+func TestAdvanceWatermarkIgnoresOlderEvents(t *testing.T) {
+	watermark := time.Now().UTC()
+	older := watermark.Add(-time.Minute)
+	next := advanceWatermark(watermark, older)
+	if !next.Equal(watermark) {
+		t.Fatalf("expected an older event to leave the watermark unchanged, got %v", next)
+	}
+}
+
+func TestFilterToQueryUsesEndTimeForEndSince(t *testing.T) {
+	since := time.Now().UTC()
+	f := &Filter{EndSince: since}
+	query := f.toQuery()
+	parts, ok := query["$and"].([]bson.M)
+	if !ok || len(parts) != 1 {
+		t.Fatalf("expected a single $and clause for EndSince, got %#v", query)
+	}
+	clause, ok := parts[0]["endtime"].(bson.M)
+	if !ok || clause["$gte"] != since {
+		t.Fatalf("expected an endtime $gte clause, got %#v", parts[0])
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"time"
+
+	"github.com/tsuru/tsuru/auth"
+	"github.com/tsuru/tsuru/permission"
+)
+
+// TypedEvent wraps an Event whose StartData, EndData and OtherData shapes
+// are known at compile time, avoiding the interface{} plus
+// json.Marshal/json.Unmarshal round trip StartData/EndData/OtherData
+// perform on every call. It embeds *Event, so every untyped method
+// (Logf, Done, TryCancel, ...) keeps working unchanged.
+type TypedEvent[Start, End, Other any] struct {
+	*Event
+}
+
+// TypedOpts mirrors Opts, replacing the untyped CustomData field with a
+// Start value so NewTyped/NewTypedInternal callers don't need to build an
+// interface{} by hand.
+type TypedOpts[Start any] struct {
+	Target       Target
+	Kind         *permission.PermissionScheme
+	InternalKind string
+	Owner        auth.Token
+	RawOwner     Owner
+	Cancelable   bool
+	CustomData   Start
+}
+
+func (o TypedOpts[Start]) toOpts() *Opts {
+	return &Opts{
+		Target:       o.Target,
+		Kind:         o.Kind,
+		InternalKind: o.InternalKind,
+		Owner:        o.Owner,
+		RawOwner:     o.RawOwner,
+		Cancelable:   o.Cancelable,
+		CustomData:   o.CustomData,
+	}
+}
+
+// NewTyped creates an event the same way New does, storing opts.CustomData
+// without the interface{} indirection New itself would require.
+func NewTyped[Start, End, Other any](opts TypedOpts[Start]) (*TypedEvent[Start, End, Other], error) {
+	evt, err := New(opts.toOpts())
+	if err != nil {
+		return nil, err
+	}
+	return &TypedEvent[Start, End, Other]{Event: evt}, nil
+}
+
+// NewTypedInternal is the NewInternal counterpart of NewTyped.
+func NewTypedInternal[Start, End, Other any](opts TypedOpts[Start]) (*TypedEvent[Start, End, Other], error) {
+	evt, err := NewInternal(opts.toOpts())
+	if err != nil {
+		return nil, err
+	}
+	return &TypedEvent[Start, End, Other]{Event: evt}, nil
+}
+
+// StartData decodes the event's start data as Start, skipping the
+// untyped json round trip when the concrete value stored in
+// StartCustomData already has the right type (always true for events
+// created through NewTyped in the same process).
+func (e *TypedEvent[Start, End, Other]) StartData() (Start, error) {
+	if v, ok := e.StartCustomData.(Start); ok {
+		return v, nil
+	}
+	var value Start
+	err := e.Event.StartData(&value)
+	return value, err
+}
+
+// EndData decodes the event's end data as End.
+func (e *TypedEvent[Start, End, Other]) EndData() (End, error) {
+	if v, ok := e.EndCustomData.(End); ok {
+		return v, nil
+	}
+	var value End
+	err := e.Event.EndData(&value)
+	return value, err
+}
+
+// DoneTyped finishes the event storing data as its typed end data.
+func (e *TypedEvent[Start, End, Other]) DoneTyped(evtErr error, data End) error {
+	return e.Event.DoneCustomData(evtErr, data)
+}
+
+// SetOtherCustomData stores data as the event's other custom data without
+// the caller needing to build an interface{} by hand.
+func (e *TypedEvent[Start, End, Other]) SetOtherCustomData(data Other) error {
+	return e.Event.SetOtherCustomData(data)
+}
+
+// OtherData decodes the event's other custom data as Other.
+func (e *TypedEvent[Start, End, Other]) OtherData() (Other, error) {
+	if v, ok := e.OtherCustomData.(Other); ok {
+		return v, nil
+	}
+	var value Other
+	err := e.Event.OtherData(&value)
+	return value, err
+}
+
+// FilterBuilder builds a Filter through chained calls instead of callers
+// assembling bson.M fragments by hand through Filter.Raw. Build returns
+// the underlying *Filter once every constraint has been set.
+type FilterBuilder struct {
+	filter Filter
+}
+
+// NewFilter starts a new FilterBuilder.
+func NewFilter() *FilterBuilder {
+	return &FilterBuilder{}
+}
+
+// Kind restricts the filter to events of the given permission kind name.
+func (b *FilterBuilder) Kind(name string) *FilterBuilder {
+	b.filter.KindName = name
+	return b
+}
+
+// Target restricts the filter to events for the given target.
+func (b *FilterBuilder) Target(target Target) *FilterBuilder {
+	b.filter.Target = target
+	return b
+}
+
+// Owner restricts the filter to events owned by name.
+func (b *FilterBuilder) Owner(name string) *FilterBuilder {
+	b.filter.OwnerName = name
+	return b
+}
+
+// Since restricts the filter to events started at or after t.
+func (b *FilterBuilder) Since(t time.Time) *FilterBuilder {
+	b.filter.Since = t
+	return b
+}
+
+// Until restricts the filter to events started at or before t.
+func (b *FilterBuilder) Until(t time.Time) *FilterBuilder {
+	b.filter.Until = t
+	return b
+}
+
+// Running restricts the filter to events currently running (or not).
+func (b *FilterBuilder) Running(running bool) *FilterBuilder {
+	b.filter.Running = &running
+	return b
+}
+
+// Build returns the Filter assembled so far, ready to be passed to List.
+func (b *FilterBuilder) Build() *Filter {
+	return &b.filter
+}
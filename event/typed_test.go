@@ -0,0 +1,73 @@
+// Copyright 2016 tsuru authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package event
+
+import (
+	"testing"
+	"time"
+)
+
+type deployStartData struct {
+	Revision string
+}
+
+type deployEndData struct {
+	Image string
+}
+
+func TestNewTypedRoundTrip(t *testing.T) {
+	store := newFakeStorage()
+	SetStorage(store)
+	defer SetStorage(nil)
+
+	target := Target{Name: "app", Value: "myapp"}
+	evt, err := NewTypedInternal[deployStartData, deployEndData, struct{}](TypedOpts[deployStartData]{
+		Target:       target,
+		InternalKind: "deploy",
+		CustomData:   deployStartData{Revision: "abc123"},
+	})
+	if err != nil {
+		t.Fatalf("expected NewTypedInternal to succeed through NewInternal's validation, got: %s", err)
+	}
+
+	start, err := evt.StartData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start.Revision != "abc123" {
+		t.Fatalf("expected the fast-path type assertion to return the original value, got %+v", start)
+	}
+
+	if err := evt.DoneTyped(nil, deployEndData{Image: "myimage:latest"}); err != nil {
+		t.Fatal(err)
+	}
+	end, err := evt.EndData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end.Image != "myimage:latest" {
+		t.Fatalf("expected end data to round trip, got %+v", end)
+	}
+}
+
+func TestFilterBuilderBuild(t *testing.T) {
+	since := time.Now().UTC()
+	f := NewFilter().Kind("app.deploy").Target(Target{Name: "app", Value: "myapp"}).Owner("me").Since(since).Running(true).Build()
+	if f.KindName != "app.deploy" {
+		t.Fatalf("expected KindName to be set, got %q", f.KindName)
+	}
+	if f.Target.Value != "myapp" {
+		t.Fatalf("expected Target to be set, got %+v", f.Target)
+	}
+	if f.OwnerName != "me" {
+		t.Fatalf("expected OwnerName to be set, got %q", f.OwnerName)
+	}
+	if !f.Since.Equal(since) {
+		t.Fatalf("expected Since to be set, got %v", f.Since)
+	}
+	if f.Running == nil || !*f.Running {
+		t.Fatalf("expected Running to be true, got %v", f.Running)
+	}
+}